@@ -5,11 +5,14 @@
 package broker
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -25,6 +28,26 @@ const (
 	// deadlineSoonDelay defines a period to sleep between receiving
 	// DEADLINE_SOON in response to reserve, and re-attempting the reserve.
 	deadlineSoonDelay = 1 * time.Second
+
+	// defaultBackoffBase is the initial reconnect delay, used when
+	// Broker.BackoffBase is zero.
+	defaultBackoffBase = 500 * time.Millisecond
+
+	// defaultBackoffMax caps the reconnect delay, used when
+	// Broker.BackoffMax is zero.
+	defaultBackoffMax = 30 * time.Second
+
+	// defaultKillGrace is the delay between SIGTERM and SIGKILL on TTR
+	// timeout, used when Broker.KillGrace is zero.
+	defaultKillGrace = 10 * time.Second
+
+	// defaultMaxStdoutBytes caps how much of a job's stdout/stderr is kept
+	// in its JobResult, used when Broker.MaxStdoutBytes is zero.
+	defaultMaxStdoutBytes = 1 << 20 // 1 MiB
+
+	// truncatedMarker is appended to Stdout/Stderr once MaxStdoutBytes is
+	// reached, so a truncated result is distinguishable from a short one.
+	truncatedMarker = "\n...[truncated]\n"
 )
 
 type Broker struct {
@@ -38,10 +61,60 @@ type Broker struct {
 	// Tube name this broker will service.
 	Tube string
 
+	// BackoffBase is the initial delay before the first reconnect attempt
+	// after a network error. Defaults to 500ms if zero.
+	BackoffBase time.Duration
+
+	// BackoffMax caps the exponential backoff between reconnect attempts.
+	// Defaults to 30s if zero.
+	BackoffMax time.Duration
+
+	// Disposition decides what to do with a finished job based on its
+	// JobResult. Defaults to DefaultDisposition if nil.
+	Disposition Disposition
+
+	// Concurrency is the number of jobs to reserve and execute in
+	// parallel against Tube. Defaults to 1 (fully sequential) if zero.
+	Concurrency int
+
+	// KillGrace is how long to wait after SIGTERM before escalating to
+	// SIGKILL on TTR timeout. Defaults to 10s if zero.
+	KillGrace time.Duration
+
+	// JobFormat selects how the job body and metadata are delivered to
+	// the worker's stdin. Defaults to JobFormatRaw if empty.
+	JobFormat JobFormat
+
+	// MaxStdoutBytes caps how much of a job's stdout and stderr are kept
+	// in its JobResult. Defaults to 1 MiB if zero.
+	MaxStdoutBytes int
+
 	log     *log.Logger
 	results chan<- *JobResult
+
+	// connMu guards conn/ts, since the kr/beanstalk Conn is not safe for
+	// concurrent use: every reserve and every job disposition is
+	// serialized through it, even though job execution itself runs
+	// concurrently across workers.
+	connMu sync.Mutex
+	conn   *beanstalk.Conn
+	ts     *beanstalk.TubeSet
 }
 
+// JobFormat selects how a job's body and metadata are delivered to the
+// worker process's stdin.
+type JobFormat string
+
+const (
+	// JobFormatRaw writes only the job body to stdin; metadata is exposed
+	// via BEANSTALK_* environment variables instead. This is the default.
+	JobFormatRaw JobFormat = ""
+
+	// JobFormatJSON wraps the body and its metadata as a single JSON
+	// object on stdin: {"id":..,"tube":"..","stats":{...},"body":"<base64>"}.
+	JobFormatJSON JobFormat = "json"
+)
+
 type JobResult struct {
 
 	// Buried is true if the job was buried.
@@ -53,12 +126,20 @@ type JobResult struct {
 	// ExitStatus of the command; 0 for success.
 	ExitStatus int
 
+	// Releases is the number of times this job had previously been
+	// released, as reported by beanstalkd. Populated for a Disposition
+	// to base backoff decisions on.
+	Releases int
+
 	// JobId from beanstalkd.
 	JobId uint64
 
-	// Stdout of the command.
+	// Stdout of the command, capped at MaxStdoutBytes.
 	Stdout []byte
 
+	// Stderr of the command, capped at MaxStdoutBytes.
+	Stderr []byte
+
 	// TimedOut indicates the worker exceeded TTR for the job.
 	// Note this is tracked by a timer, separately to beanstalkd.
 	TimedOut bool
@@ -78,54 +159,210 @@ func New(address, tube string, cmd string, results chan<- *JobResult) (b Broker)
 	return
 }
 
-// reserve-with-timeout until there's a job or something panic-worthy.
-func (b *Broker) mustReserveWithoutTimeout(ts *beanstalk.TubeSet) (id uint64, body []byte) {
-	var err error
-	for {
-		id, body, err = ts.Reserve(1 * time.Hour)
+// isRetryable reports whether err, as returned by the kr/beanstalk client,
+// indicates a transient network problem worth reconnecting for, as opposed
+// to a fatal protocol error.
+func isRetryable(err error) bool {
+	connErr, ok := err.(beanstalk.ConnError)
+	if !ok {
+		return true
+	}
+	switch connErr.Err {
+	case beanstalk.ErrBadFormat, beanstalk.ErrBuried, beanstalk.ErrNotFound,
+		beanstalk.ErrNotIgnored, beanstalk.ErrOOM, beanstalk.ErrDraining:
+		return false
+	default:
+		return true
+	}
+}
+
+// backoffDelay returns the delay to sleep before reconnect attempt number
+// attempt (0-based), as an exponential backoff with jitter to avoid
+// thundering-herd reconnects: with d = BackoffBase * 2^attempt, capped at
+// BackoffMax, the delay is drawn uniformly from [d/2, d].
+func (b *Broker) backoffDelay(attempt int) time.Duration {
+	base := b.BackoffBase
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	max := b.BackoffMax
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+
+	delay := base * time.Duration(int64(1)<<uint(attempt))
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// mustConnect dials beanstalkd and watches b.Tube, retrying with backoff
+// until it succeeds. It never returns an error; a persistently unreachable
+// beanstalkd just backs off forever.
+func (b *Broker) mustConnect() (conn *beanstalk.Conn, ts *beanstalk.TubeSet) {
+	for attempt := 0; ; attempt++ {
+		b.log.Println("connecting to", b.Address)
+		var err error
+		conn, err = beanstalk.Dial("tcp", b.Address)
 		if err == nil {
+			b.log.Println("watching", b.Tube)
+			ts = beanstalk.NewTubeSet(conn, b.Tube)
 			return
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrTimeout {
+		}
+
+		delay := b.backoffDelay(attempt)
+		b.log.Printf("connect failed (%v), retrying in %v", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// reservePollInterval is the per-attempt reserve-with-timeout used by
+// reserveOnce. It is deliberately short (rather than one long blocking
+// reserve) so reserve can release connMu between attempts, letting other workers
+// delete/release/bury their finished jobs on the shared connection while
+// this one's tube is empty.
+const reservePollInterval = 2 * time.Second
+
+// errReserveTimeout is returned by reserveOnce when no job became
+// available within reservePollInterval; the caller should just retry.
+var errReserveTimeout = fmt.Errorf("reserve: no job within %v", reservePollInterval)
+
+// errReserveDeadline is returned by reserveOnce on DEADLINE_SOON; the
+// caller should sleep deadlineSoonDelay and retry.
+var errReserveDeadline = fmt.Errorf("reserve: DEADLINE_SOON")
+
+// reserveOnce makes a single reserve-with-timeout call.
+func (b *Broker) reserveOnce(ts *beanstalk.TubeSet) (id uint64, body []byte, err error) {
+	id, body, err = ts.Reserve(reservePollInterval)
+	if err == nil {
+		return
+	}
+	connErr, ok := err.(beanstalk.ConnError)
+	if ok && connErr.Err == beanstalk.ErrTimeout {
+		return 0, nil, errReserveTimeout
+	}
+	if ok && connErr.Err == beanstalk.ErrDeadline {
+		return 0, nil, errReserveDeadline
+	}
+	if isRetryable(err) {
+		return
+	}
+	panic(err)
+}
+
+// reserve waits for a job, polling with reserveOnce and retrying
+// internally on timeout/DEADLINE_SOON. connMu is held only for the
+// duration of each individual reserveOnce call, not across the wait
+// between jobs, so it doesn't starve other workers' dispose calls. It
+// returns an error when the connection needs to be rebuilt, in which case
+// id and body are invalid.
+func (b *Broker) reserve() (id uint64, body []byte, err error) {
+	for {
+		b.connMu.Lock()
+		id, body, err = b.reserveOnce(b.ts)
+		b.connMu.Unlock()
+
+		switch err {
+		case errReserveTimeout:
 			continue
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrDeadline {
-			b.log.Printf("%v (retrying in %v)", err, deadlineSoonDelay)
+		case errReserveDeadline:
+			b.log.Printf("DEADLINE_SOON (retrying in %v)", deadlineSoonDelay)
 			time.Sleep(deadlineSoonDelay)
 			continue
-		} else {
-			panic(err)
+		default:
+			return
 		}
 	}
 }
 
+// withConn runs fn against the broker's current connection. If fn fails
+// with a retryable network error, the connection is rebuilt once and fn
+// is retried on the fresh one; a second failure is returned to the
+// caller. connMu is held for the duration of fn, since the kr/beanstalk
+// Conn is not safe for concurrent use and these are quick RPCs (unlike
+// the blocking reserve wait, which uses its own short-lived locking).
+func (b *Broker) withConn(fn func(conn *beanstalk.Conn) error) error {
+	b.connMu.Lock()
+	conn := b.conn
+	err := fn(conn)
+	if err == nil || !isRetryable(err) {
+		b.connMu.Unlock()
+		return err
+	}
+
+	b.log.Printf("connection error (%v), reconnecting", err)
+	if b.conn == conn {
+		b.conn, b.ts = b.mustConnect()
+	}
+	conn = b.conn
+	err = fn(conn)
+	b.connMu.Unlock()
+	return err
+}
+
 // Run connects to beanstalkd and starts broking.
-// If ticks channel is present, one job is processed per tick.
+// If ticks channel is present, one job is processed per tick. Concurrency
+// workers reserve and execute jobs in parallel against the same tube; each
+// worker is otherwise equivalent to the single-worker loop this broker
+// originally ran.
 func (b *Broker) Run(ticks chan bool) {
 	b.log.Println("command:", b.Cmd)
-	b.log.Println("connecting to", b.Address)
-	conn, err := beanstalk.Dial("tcp", b.Address)
-	if err != nil {
-		panic(err)
+	b.conn, b.ts = b.mustConnect()
+
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
 	}
 
-	b.log.Println("watching", b.Tube)
-	ts := beanstalk.NewTubeSet(conn, b.Tube)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			b.work(ticks)
+		}()
+	}
+	wg.Wait()
 
+	b.log.Println("broker finished")
+}
+
+// work runs the reserve/execute/dispose loop. Multiple workers may run this
+// concurrently, sharing the broker's connection; one tick (if ticks is
+// non-nil) is consumed per job dispatched, across all workers.
+func (b *Broker) work(ticks chan bool) {
 	for {
 		if ticks != nil {
 			if _, ok := <-ticks; !ok {
-				break
+				return
 			}
 		}
 
 		b.log.Println("reserve (waiting for job)")
-		id, body := b.mustReserveWithoutTimeout(ts)
-		job := &job{id: id, body: body, conn: conn}
+		id, body, err := b.reserve()
+		if err != nil {
+			b.log.Println("reserve failed, reconnecting:", err)
+			b.connMu.Lock()
+			b.conn, b.ts = b.mustConnect()
+			b.connMu.Unlock()
+			if b.results != nil {
+				b.results <- &JobResult{Error: err}
+			}
+			continue
+		}
+		job := &job{id: id, body: body, b: b}
 
-		t, err := job.timeouts()
+		stats, err := job.stats()
 		if err != nil {
-			log.Panic(err)
+			b.log.Printf("job %d: error fetching stats: %v", job.id, err)
+			if b.results != nil {
+				b.results <- &JobResult{JobId: job.id, Error: err}
+			}
+			continue
 		}
-		if t > 0 {
+
+		if t := timeoutsFromStats(stats); t > 0 {
 			b.log.Printf("job %d has %d timeouts, burying", job.id, t)
 			job.bury()
 			if b.results != nil {
@@ -135,14 +372,20 @@ func (b *Broker) Run(ticks chan bool) {
 		}
 
 		b.log.Printf("executing job %d", job.id)
-		result, err := b.executeJob(job, b.Cmd)
+		result, err := b.executeJob(job, b.Cmd, stats)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		err = b.handleResult(job, result)
-		if err != nil {
-			log.Panic(err)
+		if !result.TimedOut && result.Error == nil {
+			result.Releases = releasesFromStats(stats)
+		}
+
+		if result.Error == nil {
+			if derr := b.handleResult(job, result); derr != nil {
+				b.log.Printf("job %d: error applying disposition: %v", job.id, derr)
+				result.Error = derr
+			}
 		}
 
 		if result.Error != nil {
@@ -153,74 +396,204 @@ func (b *Broker) Run(ticks chan bool) {
 			b.results <- result
 		}
 	}
-
-	b.log.Println("broker finished")
 }
 
-func (b *Broker) executeJob(job *job, shellCmd string) (result *JobResult, err error) {
+// executeJob runs shellCmd for job. stats is job's stats-job dictionary,
+// fetched once by the caller and reused here for the TTR timer and the
+// job metadata exposed to the worker, rather than re-querying beanstalkd.
+func (b *Broker) executeJob(job *job, shellCmd string, stats map[string]string) (result *JobResult, err error) {
 	result = &JobResult{JobId: job.id, Executed: true}
 
-	ttr, err := job.timeLeft()
-	timer := time.NewTimer(ttr + ttrMargin)
-	if err != nil {
-		return
+	timer := time.NewTimer(timeLeftFromStats(stats) + ttrMargin)
+
+	input := job.body
+	if b.JobFormat == JobFormatJSON {
+		input, err = wrapJobJSON(job, b.Tube, stats)
+		if err != nil {
+			return
+		}
 	}
 
-	cmd, stdout, err := startCommand(shellCmd, job.body)
+	cmd, stdout, stderr, err := startCommand(shellCmd, input, jobEnv(job, b.Tube, stats))
 	if err != nil {
 		return
 	}
 
-	waitC := make(chan error)
+	maxBytes := b.MaxStdoutBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxStdoutBytes
+	}
+
+	stdoutC := make(chan []byte)
+	stderrC := make(chan []byte)
+
+	// cmd.Wait must not be called until both pipes have been fully read
+	// (the exec package closes them once the process exits, which would
+	// race readToChannel's reads of whatever is still buffered), so wait
+	// for the readers to finish draining before waiting on the process.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		readToChannel(stdout, stdoutC)
+	}()
 	go func() {
-		waitC <- cmd.Wait()
+		defer readers.Done()
+		readToChannel(stderr, stderrC)
 	}()
 
-	stdoutC := make(chan []byte)
-	go readToChannel(stdout, stdoutC)
+	doneC := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(doneC)
+	}()
+
+	killGrace := b.KillGrace
+	if killGrace <= 0 {
+		killGrace = defaultKillGrace
+	}
+	var killTimer *time.Timer
 
 	for {
+		var killC <-chan time.Time
+		if killTimer != nil {
+			killC = killTimer.C
+		}
 		select {
-		case err = <-waitC:
+		case <-doneC:
 			timer.Stop()
+			if killTimer != nil {
+				killTimer.Stop()
+			}
+			err = cmd.Wait()
 			if e1, ok := err.(*exec.ExitError); ok {
 				result.ExitStatus = e1.Sys().(syscall.WaitStatus).ExitStatus()
 				err = nil // not a executeJob error
 			}
 			return
 		case <-timer.C:
-			b.log.Printf("Sending SIGTERM to worker PID %d", cmd.Process.Pid)
-			cmd.Process.Signal(syscall.SIGTERM)
+			b.log.Printf("job %d exceeded TTR, sending SIGTERM to process group %d", job.id, cmd.Process.Pid)
+			signalProcessGroup(cmd, syscall.SIGTERM)
 			result.TimedOut = true
-			// TODO: follow up with SIGKILL if still running.
-		case data := <-stdoutC:
+			killTimer = time.NewTimer(killGrace)
+		case <-killC:
+			b.log.Printf("job %d still running %v after SIGTERM, sending SIGKILL", job.id, killGrace)
+			signalProcessGroup(cmd, syscall.SIGKILL)
+		case data, ok := <-stdoutC:
+			if !ok {
+				stdoutC = nil
+				continue
+			}
 			b.log.Printf("stdout:\n%s", data)
-			result.Stdout = append(result.Stdout, data...)
+			appendCapped(&result.Stdout, data, maxBytes)
+		case data, ok := <-stderrC:
+			if !ok {
+				stderrC = nil
+				continue
+			}
+			os.Stderr.Write(data)
+			appendCapped(&result.Stderr, data, maxBytes)
 		}
 	}
 }
 
+// signalProcessGroup sends sig to cmd's whole process group (cmd must have
+// been started with Setpgid: true), so shell pipelines spawned by
+// /bin/bash -c are terminated along with bash itself.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// appendCapped appends data to *dst, truncating with truncatedMarker once
+// maxBytes is reached so a runaway worker's output can't OOM the broker.
+func appendCapped(dst *[]byte, data []byte, maxBytes int) {
+	if len(*dst) >= maxBytes {
+		// A length of exactly maxBytes means the cap was filled without
+		// the marker; more data means the output was truncated after all.
+		if len(*dst) == maxBytes && len(data) > 0 {
+			*dst = append(*dst, []byte(truncatedMarker)...)
+		}
+		return
+	}
+	room := maxBytes - len(*dst)
+	if len(data) > room {
+		*dst = append(*dst, data[:room]...)
+		*dst = append(*dst, []byte(truncatedMarker)...)
+		return
+	}
+	*dst = append(*dst, data...)
+}
+
 func (b *Broker) handleResult(job *job, result *JobResult) (err error) {
 	if result.TimedOut {
 		b.log.Printf("job %d timed out", job.id)
 		return
 	}
 	b.log.Printf("job %d finished with exit(%d)", job.id, result.ExitStatus)
-	switch result.ExitStatus {
-	case 0:
+
+	disposition := b.Disposition
+	if disposition == nil {
+		disposition = DefaultDisposition{}
+	}
+	action, delay := disposition.Decide(result)
+
+	switch action {
+	case Delete:
 		b.log.Printf("deleting job %d", job.id)
 		err = job.delete()
-	case 1:
+	case Release:
 		b.log.Printf("releasing job %d", job.id)
 		err = job.release()
+	case ReleaseWithDelay:
+		b.log.Printf("releasing job %d with delay %v", job.id, delay)
+		err = job.releaseWithDelay(delay)
+	case Bury:
+		b.log.Printf("burying job %d", job.id)
+		err = job.bury()
+	case Touch:
+		b.log.Printf("touching job %d", job.id)
+		err = job.touch()
+	case None:
+		b.log.Printf("job %d: no disposition for exit status %d, leaving reserved", job.id, result.ExitStatus)
+		err = fmt.Errorf("no disposition for exit status %d", result.ExitStatus)
 	default:
-		err = fmt.Errorf("Unhandled exit status %d", result.ExitStatus)
+		err = fmt.Errorf("unhandled exit status %d", result.ExitStatus)
 	}
 	return
 }
 
-func startCommand(shellCmd string, input []byte) (cmd *exec.Cmd, stdout io.ReadCloser, err error) {
+// jobEnv builds the BEANSTALK_* environment variables exposing a job's
+// identity and stats-job metadata to the worker process.
+func jobEnv(job *job, tube string, stats map[string]string) []string {
+	return []string{
+		fmt.Sprintf("BEANSTALK_JOB_ID=%d", job.id),
+		"BEANSTALK_TUBE=" + tube,
+		"BEANSTALK_PRIORITY=" + stats["pri"],
+		"BEANSTALK_AGE=" + stats["age"],
+		"BEANSTALK_TIME_LEFT=" + stats["time-left"],
+		"BEANSTALK_RELEASES=" + stats["releases"],
+		"BEANSTALK_RESERVES=" + stats["reserves"],
+	}
+}
+
+// jsonJob is the stdin payload written for JobFormatJSON.
+type jsonJob struct {
+	ID    uint64            `json:"id"`
+	Tube  string            `json:"tube"`
+	Stats map[string]string `json:"stats"`
+	Body  []byte            `json:"body"`
+}
+
+// wrapJobJSON marshals job's body and metadata for JobFormatJSON. Body is
+// base64-encoded by encoding/json, since it's an arbitrary byte string.
+func wrapJobJSON(job *job, tube string, stats map[string]string) ([]byte, error) {
+	return json.Marshal(jsonJob{ID: job.id, Tube: tube, Stats: stats, Body: job.body})
+}
+
+func startCommand(shellCmd string, input []byte, env []string) (cmd *exec.Cmd, stdout, stderr io.ReadCloser, err error) {
 	cmd = exec.Command("/bin/bash", "-c", shellCmd)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(), env...)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -232,7 +605,10 @@ func startCommand(shellCmd string, input []byte) (cmd *exec.Cmd, stdout io.ReadC
 		return
 	}
 
-	cmd.Stderr = os.Stderr
+	stderr, err = cmd.StderrPipe()
+	if err != nil {
+		return
+	}
 
 	err = cmd.Start()
 	if err != nil {
@@ -248,13 +624,23 @@ func startCommand(shellCmd string, input []byte) (cmd *exec.Cmd, stdout io.ReadC
 	return
 }
 
+// readToChannel streams reader to c in chunks as they're read, closing c
+// once reader is exhausted. Each chunk sent is a fresh copy of what was
+// read, so accumulating every chunk (as executeJob does) reproduces the
+// full output verbatim instead of just whatever was left in a reused
+// buffer at EOF.
 func readToChannel(reader io.Reader, c chan []byte) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, 4096)
 	for {
-		_, err := reader.Read(buf)
+		n, err := reader.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			c <- chunk
+		}
 		if err != nil {
 			break
 		}
 	}
-	c <- buf
+	close(c)
 }
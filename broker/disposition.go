@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"time"
+)
+
+// Action is a disposition instructing the broker what to do with a job
+// once its command has finished.
+type Action int
+
+const (
+	// Delete removes the job from beanstalkd.
+	Delete Action = iota
+
+	// Release puts the job back into the ready queue immediately.
+	Release
+
+	// ReleaseWithDelay puts the job back into the ready queue after a delay.
+	ReleaseWithDelay
+
+	// Bury moves the job out of the ready queue into the buried state.
+	Bury
+
+	// Touch resets the job's TTR without changing its state.
+	Touch
+
+	// None takes no action on the job, leaving it reserved until beanstalkd
+	// re-queues it on TTR expiry. This matches cmdstalk's original
+	// behavior for unrecognized exit statuses.
+	None
+)
+
+// Disposition decides what to do with a job based on the result of running
+// its command.
+type Disposition interface {
+	// Decide returns the Action to take, and the delay to use when the
+	// Action is ReleaseWithDelay.
+	Decide(result *JobResult) (Action, time.Duration)
+}
+
+// DefaultDisposition reproduces cmdstalk's original hard-coded behavior:
+// exit 0 deletes, exit 1 releases, anything else is left alone and
+// reported as an error.
+type DefaultDisposition struct{}
+
+// Decide implements Disposition.
+func (DefaultDisposition) Decide(result *JobResult) (Action, time.Duration) {
+	switch result.ExitStatus {
+	case 0:
+		return Delete, 0
+	case 1:
+		return Release, 0
+	default:
+		return None, 0
+	}
+}
+
+// ExitMapping is the disposition to apply for a single exit code.
+type ExitMapping struct {
+	Action Action
+
+	// Delay is used only when Action is ReleaseWithDelay.
+	Delay time.Duration
+}
+
+// ExitCodeDisposition maps exit codes to dispositions. It understands a
+// richer set of exit codes than DefaultDisposition out of the box:
+//
+//	0 - delete
+//	1 - release, with a delay that grows linearly with the job's prior
+//	    release count (releases * ReleaseDelayStep)
+//	2 - bury
+//	3 - release with a fixed delay of ReleaseDelayStep
+//
+// Mappings overrides any of these, keyed by exit code, for per-tube
+// customization (e.g. from a --on-exit CLI flag).
+type ExitCodeDisposition struct {
+	Mappings map[int]ExitMapping
+
+	// ReleaseDelayStep is the unit of delay used by the built-in mappings
+	// for exit codes 1 and 3. Defaults to 0 (no delay) when zero.
+	ReleaseDelayStep time.Duration
+}
+
+// Decide implements Disposition.
+func (d ExitCodeDisposition) Decide(result *JobResult) (Action, time.Duration) {
+	if m, ok := d.Mappings[result.ExitStatus]; ok {
+		return m.Action, m.Delay
+	}
+	switch result.ExitStatus {
+	case 0:
+		return Delete, 0
+	case 1:
+		return ReleaseWithDelay, time.Duration(result.Releases) * d.ReleaseDelayStep
+	case 2:
+		return Bury, 0
+	case 3:
+		return ReleaseWithDelay, d.ReleaseDelayStep
+	default:
+		return None, 0
+	}
+}
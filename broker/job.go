@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// job wraps a single reserved beanstalkd job. b is the broker that
+// reserved it, used to reach the shared connection (and reconnect it, via
+// withConn) for every delete/release/bury/stat call.
+type job struct {
+	id   uint64
+	body []byte
+	b    *Broker
+}
+
+// timeoutsFromStats returns how many times a job has timed out (exceeded
+// its TTR while reserved), reading beanstalkd's stats-job "timeouts"
+// field out of a dictionary already fetched via job.stats.
+func timeoutsFromStats(stats map[string]string) int {
+	n, _ := strconv.Atoi(stats["timeouts"])
+	return n
+}
+
+// timeLeftFromStats returns the time remaining before a job's TTR
+// expires, reading it out of a dictionary already fetched via job.stats.
+func timeLeftFromStats(stats map[string]string) time.Duration {
+	seconds, _ := strconv.Atoi(stats["time-left"])
+	return time.Duration(seconds) * time.Second
+}
+
+// releasesFromStats returns how many times a job has previously been
+// released, reading it out of a dictionary already fetched via job.stats.
+func releasesFromStats(stats map[string]string) int {
+	n, _ := strconv.Atoi(stats["releases"])
+	return n
+}
+
+// stats fetches this job's stats-job dictionary from beanstalkd. Callers
+// needing more than one field (timeouts, time-left, releases, ...) should
+// fetch it once and reuse the result, rather than calling stats again.
+func (j *job) stats() (stats map[string]string, err error) {
+	err = j.b.withConn(func(conn *beanstalk.Conn) error {
+		var err error
+		stats, err = conn.StatsJob(j.id)
+		return err
+	})
+	return
+}
+
+func (j *job) bury() error {
+	return j.b.withConn(func(conn *beanstalk.Conn) error {
+		return conn.Bury(j.id, 0)
+	})
+}
+
+func (j *job) delete() error {
+	return j.b.withConn(func(conn *beanstalk.Conn) error {
+		return conn.Delete(j.id)
+	})
+}
+
+func (j *job) release() error {
+	return j.b.withConn(func(conn *beanstalk.Conn) error {
+		return conn.Release(j.id, 0, 0)
+	})
+}
+
+// releaseWithDelay puts the job back into the ready queue after delay.
+func (j *job) releaseWithDelay(delay time.Duration) error {
+	return j.b.withConn(func(conn *beanstalk.Conn) error {
+		return conn.Release(j.id, 0, delay)
+	})
+}
+
+// touch resets the job's TTR without changing its state.
+func (j *job) touch() error {
+	return j.b.withConn(func(conn *beanstalk.Conn) error {
+		return conn.Touch(j.id)
+	})
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Producer enqueues jobs onto a single beanstalkd tube. It is the
+// write-side counterpart to Broker, which only reserves.
+type Producer struct {
+
+	// Address of the beanstalkd server.
+	Address string
+
+	// Tube name this producer enqueues onto.
+	Tube string
+
+	conn *beanstalk.Conn
+}
+
+// NewProducer dials beanstalkd and returns a Producer that enqueues onto tube.
+func NewProducer(address, tube string) (p *Producer, err error) {
+	conn, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	p = &Producer{Address: address, Tube: tube, conn: conn}
+	return
+}
+
+// Put enqueues body onto the producer's tube with the given priority, delay
+// and time-to-run, returning the new job's id.
+func (p *Producer) Put(body []byte, pri uint32, delay, ttr time.Duration) (id uint64, err error) {
+	tube := &beanstalk.Tube{Conn: p.conn, Name: p.Tube}
+	return tube.Put(body, pri, delay, ttr)
+}
+
+// Close releases the producer's connection to beanstalkd.
+func (p *Producer) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,188 @@
+/*
+cmdstalk reserves jobs from a beanstalkd tube and executes a shell command
+for each one. The "put" subcommand does the reverse: it reads job bodies
+from stdin and enqueues them onto a tube.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JensRantil/cmdstalk/broker"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "put" {
+		runPut(os.Args[2:])
+		return
+	}
+	runReserve(os.Args[1:])
+}
+
+func runReserve(args []string) {
+	fs := flag.NewFlagSet("cmdstalk", flag.ExitOnError)
+	address := fs.String("address", "127.0.0.1:11300", "beanstalkd address")
+	tube := fs.String("tube", "default", "tube to watch")
+	cmd := fs.String("cmd", "", "shell command to run for each job")
+	onExit := fs.String("on-exit", "", "comma-separated exit code dispositions, e.g. 2:bury,3:delay=30s")
+	releaseDelayStep := fs.Duration("release-delay-step", 0, "delay unit used by the built-in exit 1/3 release backoff")
+	concurrency := fs.Int("concurrency", 1, "number of jobs to reserve and execute in parallel")
+	killGrace := fs.Duration("kill-grace", 10*time.Second, "delay between SIGTERM and SIGKILL on TTR timeout")
+	jobFormat := fs.String("job-format", "raw", "how to deliver the job to the worker's stdin: raw or json")
+	maxStdoutBytes := fs.Int("max-stdout-bytes", 1<<20, "cap on captured stdout/stderr per job, in bytes")
+	fs.Parse(args)
+
+	if *jobFormat != "raw" && *jobFormat != "json" {
+		fmt.Fprintf(os.Stderr, "cmdstalk: invalid -job-format %q\n", *jobFormat)
+		os.Exit(2)
+	}
+
+	if *cmd == "" {
+		fmt.Fprintln(os.Stderr, "cmdstalk: -cmd is required")
+		os.Exit(2)
+	}
+
+	mappings, err := parseOnExit(*onExit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := broker.New(*address, *tube, *cmd, nil)
+	b.Disposition = broker.ExitCodeDisposition{
+		Mappings:         mappings,
+		ReleaseDelayStep: *releaseDelayStep,
+	}
+	b.Concurrency = *concurrency
+	b.KillGrace = *killGrace
+	if *jobFormat == "json" {
+		b.JobFormat = broker.JobFormatJSON
+	}
+	b.MaxStdoutBytes = *maxStdoutBytes
+	b.Run(nil)
+}
+
+// parseOnExit parses a --on-exit flag value, e.g. "2:bury,3:delay=30s",
+// into a broker.ExitCodeDisposition mapping.
+func parseOnExit(spec string) (map[int]broker.ExitMapping, error) {
+	mappings := map[int]broker.ExitMapping{}
+	if spec == "" {
+		return mappings, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --on-exit entry %q", entry)
+		}
+
+		code, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code in %q: %v", entry, err)
+		}
+
+		switch action := parts[1]; {
+		case action == "delete":
+			mappings[code] = broker.ExitMapping{Action: broker.Delete}
+		case action == "release":
+			mappings[code] = broker.ExitMapping{Action: broker.Release}
+		case action == "bury":
+			mappings[code] = broker.ExitMapping{Action: broker.Bury}
+		case action == "touch":
+			mappings[code] = broker.ExitMapping{Action: broker.Touch}
+		case strings.HasPrefix(action, "delay="):
+			delay, err := time.ParseDuration(strings.TrimPrefix(action, "delay="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay in %q: %v", entry, err)
+			}
+			mappings[code] = broker.ExitMapping{Action: broker.ReleaseWithDelay, Delay: delay}
+		default:
+			return nil, fmt.Errorf("invalid --on-exit action %q", action)
+		}
+	}
+
+	return mappings, nil
+}
+
+// runPut reads job bodies from stdin and enqueues each onto the given
+// tube, in one of three framings: one job per line (the default), all of
+// stdin as a single job (-single), or a stream of 4-byte big-endian
+// length prefixes each followed by that many body bytes (-length-prefixed
+// — the only framing that can carry several bodies with embedded newlines).
+func runPut(args []string) {
+	fs := flag.NewFlagSet("cmdstalk put", flag.ExitOnError)
+	address := fs.String("address", "127.0.0.1:11300", "beanstalkd address")
+	tube := fs.String("tube", "default", "tube to put jobs onto")
+	pri := fs.Uint("pri", 1024, "job priority (lower is more urgent)")
+	delay := fs.Duration("delay", 0, "delay before the job becomes ready")
+	ttr := fs.Duration("ttr", 60*time.Second, "time-to-run allotted to the job")
+	single := fs.Bool("single", false, "treat all of stdin as a single job body, instead of one job per line")
+	lengthPrefixed := fs.Bool("length-prefixed", false, "read stdin as a stream of 4-byte big-endian length prefixes, each followed by that many body bytes")
+	fs.Parse(args)
+
+	p, err := broker.NewProducer(*address, *tube)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer p.Close()
+
+	switch {
+	case *single:
+		body, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		put(p, body, uint32(*pri), *delay, *ttr)
+
+	case *lengthPrefixed:
+		putLengthPrefixed(p, os.Stdin, uint32(*pri), *delay, *ttr)
+
+	default:
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			put(p, scanner.Bytes(), uint32(*pri), *delay, *ttr)
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// putLengthPrefixed reads a stream of 4-byte big-endian length prefixes,
+// each followed by that many body bytes, putting one job per frame, until
+// EOF.
+func putLengthPrefixed(p *broker.Producer, r io.Reader, pri uint32, delay, ttr time.Duration) {
+	var lenBuf [4]byte
+	for {
+		_, err := io.ReadFull(r, lenBuf[:])
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			log.Fatal(err)
+		}
+		put(p, body, pri, delay, ttr)
+	}
+}
+
+func put(p *broker.Producer, body []byte, pri uint32, delay, ttr time.Duration) {
+	id, err := p.Put(body, pri, delay, ttr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(id)
+}